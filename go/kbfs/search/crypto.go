@@ -0,0 +1,575 @@
+// Copyright 2019 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/keybase/client/go/kbfs/libfs"
+	"github.com/keybase/client/go/kbfs/libkbfs"
+	"github.com/keybase/client/go/kbfs/tlf"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// indexKeyPurpose scopes the per-TLF secret used to encrypt the search
+// index away from any other KBFS use of that secret.
+const indexKeyPurpose = "kbfs search index v1"
+
+// Frame-based AEAD layout for the on-disk Bleve index.
+//
+// Each underlying file opened through openFile starts with a fixed-size
+// header, followed by a sequence of frames. All frames except possibly
+// the last are frameSize bytes of plaintext; Scorch's random-access
+// ReadAt/WriteAt calls are translated to whichever frames they overlap,
+// decrypting or re-encrypting those frames whole. This trades some
+// read/write amplification on partial-frame access for a simple,
+// streaming-friendly on-disk format.
+//
+// Every sealed frame carries its own random nonce, stored immediately
+// ahead of the ciphertext; frameAD additionally binds the key id and
+// frame index into the AEAD's associated data so a frame can't be
+// silently moved to another offset or file. Nonces are never derived
+// from the (static) keyID, which would make every frame sealed under a
+// given key reuse nonces across writes.
+const (
+	indexFileMagic          = "KBFI"
+	indexFileVersion   byte = 2
+	cipherXChaCha20Poly1305 byte = 1
+
+	frameSize = 64 * 1024
+
+	// saltSize is the size of the per-file HKDF salt stored in the file
+	// header, so deriveIndexKey can reproduce the same key from the TLF's
+	// crypt key without any out-of-band state, and a future key rotation
+	// can mint a new salt without changing that crypt key.
+	saltSize = 16
+
+	headerSize = 4 /* magic */ + 1 /* version */ + 1 /* cipher id */ +
+		saltSize + 32 /* key id */
+)
+
+type indexFileHeader struct {
+	cipherID byte
+	salt     [saltSize]byte
+	keyID    [32]byte
+}
+
+func encodeIndexFileHeader(h indexFileHeader) []byte {
+	buf := make([]byte, headerSize)
+	copy(buf[0:4], indexFileMagic)
+	buf[4] = indexFileVersion
+	buf[5] = h.cipherID
+	off := 6
+	copy(buf[off:off+saltSize], h.salt[:])
+	off += saltSize
+	copy(buf[off:off+32], h.keyID[:])
+	return buf
+}
+
+func decodeIndexFileHeader(buf []byte) (h indexFileHeader, err error) {
+	if len(buf) < headerSize {
+		return h, errors.Errorf("index file header too short: %d bytes", len(buf))
+	}
+	if string(buf[0:4]) != indexFileMagic {
+		return h, errors.New("index file missing encryption header")
+	}
+	if buf[4] != indexFileVersion {
+		return h, errors.Errorf("unsupported index file version %d", buf[4])
+	}
+	h.cipherID = buf[5]
+	off := 6
+	copy(h.salt[:], buf[off:off+saltSize])
+	off += saltSize
+	copy(h.keyID[:], buf[off:off+32])
+	return h, nil
+}
+
+// randomAccessFile is the subset of file behavior the encrypted index
+// wrapper needs from the file libfs.FS's openFile hook returns: the
+// random access Scorch relies on for mmap-style segment access, plus
+// Stat, Truncate and Close. Streaming Read/Write are provided by
+// encryptedFile on top of ReadAt/WriteAt.
+type randomAccessFile interface {
+	io.Closer
+	io.ReaderAt
+	io.WriterAt
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// frameCipher seals and opens individual frames of an encryptedFile.
+type frameCipher struct {
+	aead cipher.AEAD
+}
+
+func newFrameCipher(key [32]byte) (*frameCipher, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return &frameCipher{aead: aead}, nil
+}
+
+// frameAD binds a sealed frame to the key it was sealed under and its
+// position within the file, so moving a frame to a different frame index
+// fails authentication instead of silently decrypting. Frames at the same
+// index of two files sharing a keyID get the same associated data.
+func frameAD(keyID [32]byte, frameIndex uint64) []byte {
+	ad := make([]byte, 32+8)
+	copy(ad, keyID[:])
+	binary.LittleEndian.PutUint64(ad[32:], frameIndex)
+	return ad
+}
+
+// seal encrypts plaintext under a freshly generated random nonce, which
+// it prepends to the returned ciphertext.
+func (fc *frameCipher) seal(keyID [32]byte, frameIndex uint64, plaintext []byte) (
+	[]byte, error) {
+	nonce := make([]byte, fc.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return fc.aead.Seal(nonce, nonce, plaintext, frameAD(keyID, frameIndex)), nil
+}
+
+// open reverses seal, reading the nonce back off the front of sealed.
+func (fc *frameCipher) open(keyID [32]byte, frameIndex uint64, sealed []byte) (
+	[]byte, error) {
+	ns := fc.aead.NonceSize()
+	if len(sealed) < ns {
+		return nil, errors.New("sealed frame shorter than a nonce")
+	}
+	nonce, ciphertext := sealed[:ns], sealed[ns:]
+	return fc.aead.Open(nil, nonce, ciphertext, frameAD(keyID, frameIndex))
+}
+
+// sealedFrameSize is the on-disk size of a frame whose plaintext is
+// plaintextFrameSize bytes: a nonce, the ciphertext, and the AEAD tag.
+func (fc *frameCipher) sealedFrameSize(plaintextFrameSize int) int {
+	return fc.aead.NonceSize() + plaintextFrameSize + fc.aead.Overhead()
+}
+
+// encryptedFile wraps a randomAccessFile, transparently encrypting every
+// frame written to it and decrypting every frame read from it. It
+// implements io.ReadWriteCloser (what bleveConfig's openFile hook
+// requires) plus the rest of randomAccessFile -- ReadAt/WriteAt/Stat/
+// Truncate, and Seek besides -- since Scorch type-asserts the value
+// openFile returns back to an interface like that for its random-access
+// segment files.
+type encryptedFile struct {
+	raw    randomAccessFile
+	cipher *frameCipher
+	keyID  [32]byte
+	offset int64
+}
+
+func frameAt(off int64) (frameIndex uint64, frameOffset int) {
+	return uint64(off / frameSize), int(off % frameSize)
+}
+
+func physicalOffset(fc *frameCipher, frameIndex uint64) int64 {
+	return headerSize + int64(frameIndex)*int64(fc.sealedFrameSize(frameSize))
+}
+
+// newEncryptedFile wraps raw, writing a fresh header (with a freshly
+// generated salt) if raw is empty, or reading back the existing header's
+// salt and re-deriving the same key otherwise. Key derivation itself goes
+// through idx.indexKeyFor, which caches by (tlfID, salt): every Bleve
+// segment file goes through this constructor, and re-deriving via
+// deriveIndexKey's MDOps/KeyManager round trip on each one would be both
+// slow and, since openFile's hook long outlives any single request, tied
+// to whatever ctx happened to be live when it ran.
+func newEncryptedFile(
+	ctx context.Context, idx *Indexer, tlfID tlf.ID, raw randomAccessFile) (
+	*encryptedFile, error) {
+	fi, err := raw.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var salt [saltSize]byte
+	if fi.Size() == 0 {
+		if _, err := rand.Read(salt[:]); err != nil {
+			return nil, err
+		}
+	} else {
+		headerBuf := make([]byte, headerSize)
+		if _, err := raw.ReadAt(headerBuf, 0); err != nil {
+			return nil, err
+		}
+		header, err := decodeIndexFileHeader(headerBuf)
+		if err != nil {
+			return nil, err
+		}
+		if header.cipherID != cipherXChaCha20Poly1305 {
+			return nil, errors.Errorf(
+				"unsupported index file cipher id %d", header.cipherID)
+		}
+		salt = header.salt
+	}
+
+	key, keyID, err := idx.indexKeyFor(ctx, tlfID, salt)
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := newFrameCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() == 0 {
+		header := encodeIndexFileHeader(indexFileHeader{
+			cipherID: cipherXChaCha20Poly1305,
+			salt:     salt,
+			keyID:    keyID,
+		})
+		if _, err := raw.WriteAt(header, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return &encryptedFile{raw: raw, cipher: cipher, keyID: keyID}, nil
+}
+
+func (f *encryptedFile) readFrame(frameIndex uint64) ([]byte, error) {
+	sealed := make([]byte, f.cipher.sealedFrameSize(frameSize))
+	n, err := f.raw.ReadAt(sealed, physicalOffset(f.cipher, frameIndex))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+	return f.cipher.open(f.keyID, frameIndex, sealed[:n])
+}
+
+func (f *encryptedFile) writeFrame(frameIndex uint64, plaintext []byte) error {
+	sealed, err := f.cipher.seal(f.keyID, frameIndex, plaintext)
+	if err != nil {
+		return err
+	}
+	_, err = f.raw.WriteAt(sealed, physicalOffset(f.cipher, frameIndex))
+	return err
+}
+
+// ReadAt decrypts and returns the plaintext overlapping [off, off+len(p)).
+// Per the io.ReaderAt contract, any return with n < len(p) carries a
+// non-nil error, even on a short final read.
+func (f *encryptedFile) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		frameIndex, frameOffset := frameAt(off + int64(n))
+		plaintext, err := f.readFrame(frameIndex)
+		if err == io.EOF {
+			return n, io.EOF
+		}
+		if err != nil {
+			return n, err
+		}
+		if frameOffset >= len(plaintext) {
+			return n, io.EOF
+		}
+		copied := copy(p[n:], plaintext[frameOffset:])
+		n += copied
+	}
+	return n, nil
+}
+
+// WriteAt encrypts p and writes it at off, rewriting each whole frame p
+// overlaps (read-modify-write for partially-overlapped frames). The
+// rewritten frame keeps whichever is longer of its previous plaintext or
+// the portion p now covers, so overwriting the middle of a frame doesn't
+// truncate bytes past the write.
+func (f *encryptedFile) WriteAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		frameIndex, frameOffset := frameAt(off + int64(n))
+		plaintext, err := f.readFrame(frameIndex)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		frame := make([]byte, frameSize)
+		copy(frame, plaintext)
+		copied := copy(frame[frameOffset:], p[n:])
+		frameLen := frameOffset + copied
+		if len(plaintext) > frameLen {
+			frameLen = len(plaintext)
+		}
+		if err := f.writeFrame(frameIndex, frame[:frameLen]); err != nil {
+			return n, err
+		}
+		n += copied
+	}
+	return n, nil
+}
+
+func (f *encryptedFile) Read(p []byte) (n int, err error) {
+	n, err = f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *encryptedFile) Write(p []byte) (n int, err error) {
+	n, err = f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *encryptedFile) Close() error {
+	return f.raw.Close()
+}
+
+// Seek implements io.Seeker in terms of the logical (plaintext) offset;
+// Read/Write/ReadAt/WriteAt above don't need it, but Scorch's segment
+// I/O type-asserts for it.
+func (f *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekStart:
+		base = 0
+	case io.SeekCurrent:
+		base = f.offset
+	case io.SeekEnd:
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		base = fi.Size()
+	default:
+		return 0, errors.Errorf("encryptedFile: unsupported whence %d", whence)
+	}
+	f.offset = base + offset
+	return f.offset, nil
+}
+
+// Stat reports the logical (plaintext) size of the file, not raw's
+// physical on-disk size, which is larger by the header and the
+// per-frame nonce/tag overhead.
+func (f *encryptedFile) Stat() (os.FileInfo, error) {
+	fi, err := f.raw.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFileInfo{FileInfo: fi, size: f.logicalSize(fi.Size())}, nil
+}
+
+func (f *encryptedFile) logicalSize(physicalSize int64) int64 {
+	if physicalSize <= headerSize {
+		return 0
+	}
+	body := physicalSize - headerSize
+	sealedSize := int64(f.cipher.sealedFrameSize(frameSize))
+	fullFrames := body / sealedSize
+	rem := body % sealedSize
+
+	size := fullFrames * frameSize
+	if overhead := int64(f.cipher.sealedFrameSize(0)); rem > overhead {
+		size += rem - overhead
+	}
+	return size
+}
+
+// Truncate resizes the file to size logical (plaintext) bytes, which may
+// land in the middle of a frame; that frame is read, its plaintext
+// trimmed or zero-extended to fit, and re-sealed before the underlying
+// file is truncated to the resulting physical size.
+func (f *encryptedFile) Truncate(size int64) error {
+	if size < 0 {
+		return errors.Errorf("encryptedFile: negative truncate size %d", size)
+	}
+	fullFrames := uint64(size / frameSize)
+	remainder := int(size % frameSize)
+
+	physicalSize := physicalOffset(f.cipher, fullFrames)
+	if remainder > 0 {
+		plaintext, err := f.readFrame(fullFrames)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		frame := make([]byte, remainder)
+		copy(frame, plaintext)
+		if err := f.writeFrame(fullFrames, frame); err != nil {
+			return err
+		}
+		physicalSize += int64(f.cipher.sealedFrameSize(remainder))
+	}
+	return f.raw.Truncate(physicalSize)
+}
+
+// encryptedFileInfo overrides the physical os.FileInfo's Size with the
+// encryptedFile's logical (plaintext) size.
+type encryptedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *encryptedFileInfo) Size() int64 { return fi.size }
+
+// indexKeyCacheEntry is the memoized result of deriveIndexKey for one
+// (tlfID, salt) pair.
+type indexKeyCacheEntry struct {
+	key   [32]byte
+	keyID [32]byte
+}
+
+type tlfSaltKey struct {
+	tlfID tlf.ID
+	salt  [saltSize]byte
+}
+
+// indexKeyFor returns the symmetric key (and its id) used to encrypt
+// tlfID's search index under salt, deriving it via deriveIndexKey on
+// first use and memoizing the result so later segment-file opens -- of
+// which there can be many over an index's lifetime -- don't each pay for
+// an MDOps/KeyManager round trip.
+func (i *Indexer) indexKeyFor(
+	ctx context.Context, tlfID tlf.ID, salt [saltSize]byte) (
+	key [32]byte, keyID [32]byte, err error) {
+	ck := tlfSaltKey{tlfID: tlfID, salt: salt}
+
+	i.keysMu.Lock()
+	if e, ok := i.keys[ck]; ok {
+		i.keysMu.Unlock()
+		return e.key, e.keyID, nil
+	}
+	i.keysMu.Unlock()
+
+	key, keyID, err = deriveIndexKey(ctx, i.config, tlfID, salt)
+	if err != nil {
+		return key, keyID, err
+	}
+
+	i.keysMu.Lock()
+	if i.keys == nil {
+		i.keys = map[tlfSaltKey]indexKeyCacheEntry{}
+	}
+	i.keys[ck] = indexKeyCacheEntry{key: key, keyID: keyID}
+	i.keysMu.Unlock()
+	return key, keyID, nil
+}
+
+// deriveIndexKey derives the symmetric key used to encrypt tlfID's search
+// index from the TLF's own crypt key and salt, via HKDF-SHA256, plus a
+// key id used to detect key rotation and to bind the per-frame AEAD
+// associated data. salt is generated when each file is created and stored
+// (unencrypted) in that file's header, so a reader only needs the TLF
+// crypt key and the file itself to re-derive the key -- no separate
+// rotation state has to be kept in sync with it.
+//
+// This is not called directly from file I/O paths; go through
+// Indexer.indexKeyFor, which caches the result.
+func deriveIndexKey(
+	ctx context.Context, config libkbfs.Config, tlfID tlf.ID,
+	salt [saltSize]byte) (key [32]byte, keyID [32]byte, err error) {
+	md, err := config.MDOps().GetForTLF(ctx, tlfID, nil)
+	if err != nil {
+		return key, keyID, err
+	}
+	tlfCryptKey, err := config.KeyManager().GetTLFCryptKeyForEncryption(ctx, md)
+	if err != nil {
+		return key, keyID, err
+	}
+	secret := tlfCryptKey.Data()
+
+	kdf := hkdf.New(sha256.New, secret[:], salt[:], []byte(indexKeyPurpose))
+	if _, err := io.ReadFull(kdf, key[:]); err != nil {
+		return key, keyID, err
+	}
+	keyID = sha256.Sum256(append(append([]byte(indexKeyPurpose), salt[:]...), secret[:]...))
+	return key, keyID, nil
+}
+
+// migrateIndexFile re-encrypts p in place if it does not already start
+// with an indexFileHeader, i.e. it predates index encryption.
+func migrateIndexFile(
+	ctx context.Context, idx *Indexer, tlfID tlf.ID,
+	fs libfsOpener, p string) error {
+	raw, err := fs.OpenFile(p, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	ra, ok := raw.(randomAccessFile)
+	if !ok {
+		return raw.Close()
+	}
+	defer ra.Close()
+
+	fi, err := ra.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return nil
+	}
+	headerBuf := make([]byte, headerSize)
+	n, err := ra.ReadAt(headerBuf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if _, err := decodeIndexFileHeader(headerBuf[:n]); err == nil {
+		// Already encrypted.
+		return nil
+	}
+
+	plaintext := make([]byte, fi.Size())
+	if _, err := ra.ReadAt(plaintext, 0); err != nil && err != io.EOF {
+		return err
+	}
+	if err := ra.Truncate(0); err != nil {
+		return err
+	}
+
+	ef, err := newEncryptedFile(ctx, idx, tlfID, ra)
+	if err != nil {
+		return err
+	}
+	_, err = ef.WriteAt(plaintext, 0)
+	return err
+}
+
+// libfsOpener is the subset of *libfs.FS that migrateIndexFile needs; it
+// exists so tests can substitute an in-memory implementation.
+type libfsOpener interface {
+	OpenFile(name string, flag int, mode os.FileMode) (io.ReadWriteCloser, error)
+}
+
+// migrateIndexDir walks fs, re-encrypting in place any file that predates
+// index encryption (i.e. has no indexFileHeader). It is run once, before
+// opening an existing index, so Scorch never has to deal with a mix of
+// plaintext and encrypted segment files. cursorFileName is skipped: it's
+// our own plaintext JSON bookkeeping, not a Bleve segment file, and
+// "encrypting" it here would leave loadCursors unable to parse it back.
+func migrateIndexDir(
+	ctx context.Context, idx *Indexer, tlfID tlf.ID, fs *libfs.FS) error {
+	entries, err := fs.ReadDir("")
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if fi.IsDir() {
+			child, err := fs.ChrootAsLibFS(fi.Name())
+			if err != nil {
+				return err
+			}
+			if err := migrateIndexDir(ctx, idx, tlfID, child); err != nil {
+				return err
+			}
+			continue
+		}
+		if fi.Name() == cursorFileName {
+			continue
+		}
+		if err := migrateIndexFile(ctx, idx, tlfID, fs, fi.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2019 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memRandomAccessFile is a minimal in-memory randomAccessFile, standing in
+// for a libfs file so encryptedFile can be exercised without any KBFS
+// dependency.
+type memRandomAccessFile struct {
+	buf []byte
+}
+
+func (m *memRandomAccessFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= int64(len(m.buf)) {
+		return 0, io.EOF
+	}
+	n = copy(p, m.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memRandomAccessFile) WriteAt(p []byte, off int64) (n int, err error) {
+	end := off + int64(len(p))
+	if end > int64(len(m.buf)) {
+		grown := make([]byte, end)
+		copy(grown, m.buf)
+		m.buf = grown
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func (m *memRandomAccessFile) Truncate(size int64) error {
+	if int64(len(m.buf)) <= size {
+		grown := make([]byte, size)
+		copy(grown, m.buf)
+		m.buf = grown
+		return nil
+	}
+	m.buf = m.buf[:size]
+	return nil
+}
+
+func (m *memRandomAccessFile) Stat() (os.FileInfo, error) {
+	return memFileInfo{size: int64(len(m.buf))}, nil
+}
+
+func (m *memRandomAccessFile) Close() error { return nil }
+
+type memFileInfo struct{ size int64 }
+
+func (fi memFileInfo) Name() string       { return "mem" }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func newTestFrameCipher(t *testing.T) *frameCipher {
+	var key [32]byte
+	copy(key[:], bytes.Repeat([]byte{0x42}, 32))
+	fc, err := newFrameCipher(key)
+	require.NoError(t, err)
+	return fc
+}
+
+func TestFrameCipherSealOpenRoundTrip(t *testing.T) {
+	fc := newTestFrameCipher(t)
+	var keyID [32]byte
+	copy(keyID[:], bytes.Repeat([]byte{0x01}, 32))
+
+	plaintext := []byte("hello, encrypted index")
+	sealed, err := fc.seal(keyID, 7, plaintext)
+	require.NoError(t, err)
+
+	opened, err := fc.open(keyID, 7, sealed)
+	require.NoError(t, err)
+	require.Equal(t, plaintext, opened)
+}
+
+func TestFrameCipherSealProducesDistinctNoncesEachCall(t *testing.T) {
+	fc := newTestFrameCipher(t)
+	var keyID [32]byte
+	sealed1, err := fc.seal(keyID, 0, []byte("same plaintext"))
+	require.NoError(t, err)
+	sealed2, err := fc.seal(keyID, 0, []byte("same plaintext"))
+	require.NoError(t, err)
+	require.NotEqual(t, sealed1, sealed2)
+}
+
+func TestFrameCipherOpenRejectsTamperedFrameIndex(t *testing.T) {
+	fc := newTestFrameCipher(t)
+	var keyID [32]byte
+	sealed, err := fc.seal(keyID, 3, []byte("frame 3's plaintext"))
+	require.NoError(t, err)
+
+	_, err = fc.open(keyID, 4, sealed)
+	require.Error(t, err)
+}
+
+func TestFrameCipherOpenRejectsTamperedCiphertext(t *testing.T) {
+	fc := newTestFrameCipher(t)
+	var keyID [32]byte
+	sealed, err := fc.seal(keyID, 0, []byte("frame plaintext"))
+	require.NoError(t, err)
+
+	sealed[len(sealed)-1] ^= 0xff
+	_, err = fc.open(keyID, 0, sealed)
+	require.Error(t, err)
+}
+
+func newTestEncryptedFile(t *testing.T) *encryptedFile {
+	fc := newTestFrameCipher(t)
+	var keyID [32]byte
+	copy(keyID[:], bytes.Repeat([]byte{0x09}, 32))
+	return &encryptedFile{
+		raw:    &memRandomAccessFile{},
+		cipher: fc,
+		keyID:  keyID,
+	}
+}
+
+func TestEncryptedFileReadWriteAtRoundTrip(t *testing.T) {
+	ef := newTestEncryptedFile(t)
+	plaintext := []byte("the quick brown fox jumps over the lazy dog")
+
+	_, err := ef.WriteAt(plaintext, 0)
+	require.NoError(t, err)
+
+	got := make([]byte, len(plaintext))
+	n, err := ef.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(plaintext), n)
+	require.Equal(t, plaintext, got)
+}
+
+func TestEncryptedFileReadWriteAcrossFrameBoundary(t *testing.T) {
+	ef := newTestEncryptedFile(t)
+	// Span three frames: the last 50 bytes of the first, all of the second,
+	// and the first 50 bytes of the third.
+	plaintext := bytes.Repeat([]byte{0xab}, frameSize+100)
+	off := int64(frameSize - 50)
+
+	_, err := ef.WriteAt(plaintext, off)
+	require.NoError(t, err)
+
+	got := make([]byte, len(plaintext))
+	n, err := ef.ReadAt(got, off)
+	require.NoError(t, err)
+	require.Equal(t, len(plaintext), n)
+	require.Equal(t, plaintext, got)
+}
+
+func TestEncryptedFilePartialOverwritePreservesTail(t *testing.T) {
+	ef := newTestEncryptedFile(t)
+	original := bytes.Repeat([]byte{0x11}, frameSize)
+	_, err := ef.WriteAt(original, 0)
+	require.NoError(t, err)
+
+	// Overwrite just the first 10 bytes of the frame.
+	_, err = ef.WriteAt([]byte("0123456789"), 0)
+	require.NoError(t, err)
+
+	got := make([]byte, frameSize)
+	n, err := ef.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, frameSize, n)
+	require.Equal(t, []byte("0123456789"), got[:10])
+	require.Equal(t, original[10:], got[10:])
+}
+
+func TestEncryptedFileReadAtShortReadReturnsEOF(t *testing.T) {
+	ef := newTestEncryptedFile(t)
+	plaintext := []byte("short")
+	_, err := ef.WriteAt(plaintext, 0)
+	require.NoError(t, err)
+
+	p := make([]byte, len(plaintext)+10)
+	n, err := ef.ReadAt(p, 0)
+	require.Equal(t, len(plaintext), n)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestEncryptedFileReadAtPastEOFReturnsEOF(t *testing.T) {
+	ef := newTestEncryptedFile(t)
+	_, err := ef.WriteAt([]byte("x"), 0)
+	require.NoError(t, err)
+
+	p := make([]byte, 10)
+	n, err := ef.ReadAt(p, 100)
+	require.Equal(t, 0, n)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestEncryptedFileStatReportsLogicalSize(t *testing.T) {
+	ef := newTestEncryptedFile(t)
+	plaintext := bytes.Repeat([]byte{0x22}, frameSize+42)
+	_, err := ef.WriteAt(plaintext, 0)
+	require.NoError(t, err)
+
+	fi, err := ef.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(len(plaintext)), fi.Size())
+}
+
+func TestEncryptedFileTruncateShrinksLogicalSize(t *testing.T) {
+	ef := newTestEncryptedFile(t)
+	plaintext := bytes.Repeat([]byte{0x33}, frameSize+42)
+	_, err := ef.WriteAt(plaintext, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, ef.Truncate(10))
+
+	fi, err := ef.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(10), fi.Size())
+
+	got := make([]byte, 10)
+	n, err := ef.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	require.Equal(t, plaintext[:10], got)
+}
+
+func TestEncryptedFileSeek(t *testing.T) {
+	ef := newTestEncryptedFile(t)
+	_, err := ef.WriteAt([]byte("0123456789"), 0)
+	require.NoError(t, err)
+
+	pos, err := ef.Seek(3, io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), pos)
+
+	p := make([]byte, 4)
+	n, err := ef.Read(p)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+	require.Equal(t, []byte("3456"), p)
+}
+
+func TestIndexFileHeaderEncodeDecodeRoundTrip(t *testing.T) {
+	var salt [saltSize]byte
+	copy(salt[:], bytes.Repeat([]byte{0x7}, saltSize))
+	var keyID [32]byte
+	copy(keyID[:], bytes.Repeat([]byte{0x8}, 32))
+
+	h := indexFileHeader{
+		cipherID: cipherXChaCha20Poly1305,
+		salt:     salt,
+		keyID:    keyID,
+	}
+	decoded, err := decodeIndexFileHeader(encodeIndexFileHeader(h))
+	require.NoError(t, err)
+	require.Equal(t, h, decoded)
+}
+
+func TestDecodeIndexFileHeaderRejectsBadMagic(t *testing.T) {
+	buf := encodeIndexFileHeader(indexFileHeader{cipherID: cipherXChaCha20Poly1305})
+	buf[0] = 'X'
+	_, err := decodeIndexFileHeader(buf)
+	require.Error(t, err)
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"context"
+	"encoding/base32"
+	"path"
+	"strings"
+
+	"github.com/keybase/client/go/kbfs/libkbfs"
+	"github.com/keybase/client/go/kbfs/tlf"
+	"github.com/pkg/errors"
+)
+
+// multibaseBase32Lower is the multibase prefix code for lowercase,
+// unpadded RFC4648 base32 -- see
+// https://github.com/multiformats/multibase.
+const multibaseBase32Lower = 'b'
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// canonicalKBFSPath builds the stable, mount-independent path a given
+// relative path (forward-slash separated, relative to handle's TLF root)
+// is indexed under.
+func canonicalKBFSPath(handle *libkbfs.TlfHandle, relPath string) string {
+	return path.Join(
+		"/keybase", handle.Type().String(),
+		string(handle.GetCanonicalName()), relPath)
+}
+
+// encodeDocID turns canonicalPath into a Bleve document id that survives
+// round-tripping through filesystems with different case-folding, path
+// separator, or valid-character rules than KBFS itself.
+func encodeDocID(canonicalPath string) string {
+	return string(multibaseBase32Lower) +
+		strings.ToLower(base32Encoding.EncodeToString([]byte(canonicalPath)))
+}
+
+// decodeDocID reverses encodeDocID.
+func decodeDocID(id string) (canonicalPath string, err error) {
+	if len(id) == 0 || id[0] != multibaseBase32Lower {
+		return "", errors.Errorf("unsupported or missing multibase prefix in id %q", id)
+	}
+	data, err := base32Encoding.DecodeString(strings.ToUpper(id[1:]))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// docID is the Bleve document id for the entry at relPath under handle's
+// TLF.
+func docID(handle *libkbfs.TlfHandle, relPath string) string {
+	return encodeDocID(canonicalKBFSPath(handle, relPath))
+}
+
+// ResolveHit decodes match's id back into a canonical KBFS path and walks
+// it to the corresponding libkbfs.Node, regardless of where the index
+// that produced match was opened from.
+func (i *Indexer) ResolveHit(ctx context.Context, match Match) (libkbfs.Node, error) {
+	canonical, err := decodeDocID(match.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := strings.TrimPrefix(canonical, "/keybase/")
+	parts := strings.SplitN(trimmed, "/", 3)
+	if len(parts) < 2 {
+		return nil, errors.Errorf("malformed canonical KBFS path %q", canonical)
+	}
+	tlfType, err := tlf.ParseType(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	tlfName := parts[1]
+	var relPath string
+	if len(parts) == 3 {
+		relPath = parts[2]
+	}
+
+	handle, err := libkbfs.GetHandleFromFolderNameAndType(
+		ctx, i.config.KBPKI(), i.config.MDOps(), i.config, tlfName, tlfType)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.resolveNode(ctx, handle, relPath)
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecodeDocIDRoundTrip(t *testing.T) {
+	paths := []string{
+		"/keybase/private/alice,bob/notes/todo.md",
+		"/keybase/public/alice/README",
+		"/keybase/team/acme.eng/design docs/v2 (final).md",
+		"",
+	}
+	for _, p := range paths {
+		id := encodeDocID(p)
+		decoded, err := decodeDocID(id)
+		require.NoError(t, err)
+		require.Equal(t, p, decoded)
+	}
+}
+
+func TestEncodeDocIDMultibasePrefix(t *testing.T) {
+	id := encodeDocID("/keybase/private/alice/x")
+	require.True(t, strings.HasPrefix(id, string(multibaseBase32Lower)))
+}
+
+func TestDecodeDocIDRejectsMissingOrWrongPrefix(t *testing.T) {
+	_, err := decodeDocID("")
+	require.Error(t, err)
+
+	_, err = decodeDocID("zabcdef")
+	require.Error(t, err)
+}
+
+func TestDecodeDocIDRejectsInvalidBase32(t *testing.T) {
+	_, err := decodeDocID(string(multibaseBase32Lower) + "not-valid-base32!!!")
+	require.Error(t, err)
+}
+
+func TestDocIDDiffersByPath(t *testing.T) {
+	id1 := encodeDocID("/keybase/private/alice,bob/a.txt")
+	id2 := encodeDocID("/keybase/private/alice,bob/b.txt")
+	require.NotEqual(t, id1, id2)
+}
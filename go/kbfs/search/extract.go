@@ -0,0 +1,135 @@
+// Copyright 2019 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ContentExtractor knows how to pull indexable text out of a particular
+// kind of file so it can be fed into Bleve alongside the name fields.
+// Callers outside this package can register their own extractors (for
+// example for PDFs, which would otherwise pull a heavy parsing dependency
+// into every KBFS client) via RegisterContentExtractor.
+type ContentExtractor interface {
+	// Extensions returns the lowercase, dot-prefixed file extensions
+	// (e.g. ".md") this extractor handles.
+	Extensions() []string
+	// MimeTypes returns any MIME types this extractor handles, in
+	// addition to Extensions.
+	MimeTypes() []string
+	// DocType names the Bleve document mapping -- and therefore the set
+	// of field analyzers -- that extracted content should be indexed
+	// under. See newIndexMapping.
+	DocType() string
+	// Extract reads indexable text out of r, reading no more than
+	// maxSize bytes.
+	Extract(ctx context.Context, r io.Reader, maxSize int64) (string, error)
+}
+
+var (
+	extractorsMu     sync.RWMutex
+	extractorsByExt  = map[string]ContentExtractor{}
+	extractorsByMime = map[string]ContentExtractor{}
+)
+
+// RegisterContentExtractor makes e available for files whose extension or
+// MIME type it claims, overriding any extractor previously registered for
+// the same extension or MIME type. It is meant to be called from init()
+// functions, including those of packages that import kbfs/search solely
+// to register an extractor.
+func RegisterContentExtractor(e ContentExtractor) {
+	extractorsMu.Lock()
+	defer extractorsMu.Unlock()
+	for _, ext := range e.Extensions() {
+		extractorsByExt[strings.ToLower(ext)] = e
+	}
+	for _, mt := range e.MimeTypes() {
+		extractorsByMime[strings.ToLower(mt)] = e
+	}
+}
+
+// extractorFor returns the extractor registered for name's extension or
+// MIME type, or nil if none is registered.
+func extractorFor(name string) ContentExtractor {
+	extractorsMu.RLock()
+	defer extractorsMu.RUnlock()
+	ext := strings.ToLower(filepath.Ext(name))
+	if e, ok := extractorsByExt[ext]; ok {
+		return e
+	}
+	if mt := mime.TypeByExtension(ext); mt != "" {
+		if i := strings.IndexByte(mt, ';'); i >= 0 {
+			mt = mt[:i]
+		}
+		if e, ok := extractorsByMime[strings.ToLower(mt)]; ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterContentExtractor(plainTextExtractor{})
+	RegisterContentExtractor(markdownExtractor{})
+	RegisterContentExtractor(sourceCodeExtractor{})
+}
+
+func readLimited(r io.Reader, maxSize int64) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// plainTextExtractor indexes plain-text files verbatim.
+type plainTextExtractor struct{}
+
+func (plainTextExtractor) Extensions() []string {
+	return []string{".txt", ".log", ".csv", ".tsv"}
+}
+func (plainTextExtractor) MimeTypes() []string { return []string{"text/plain"} }
+func (plainTextExtractor) DocType() string     { return "text" }
+func (plainTextExtractor) Extract(
+	_ context.Context, r io.Reader, maxSize int64) (string, error) {
+	return readLimited(r, maxSize)
+}
+
+// markdownExtractor indexes the raw Markdown source; Bleve's analyzers
+// already strip most of the punctuation that would otherwise show up as
+// noise tokens.
+type markdownExtractor struct{}
+
+func (markdownExtractor) Extensions() []string { return []string{".md", ".markdown"} }
+func (markdownExtractor) MimeTypes() []string  { return []string{"text/markdown"} }
+func (markdownExtractor) DocType() string      { return "markdown" }
+func (markdownExtractor) Extract(
+	_ context.Context, r io.Reader, maxSize int64) (string, error) {
+	return readLimited(r, maxSize)
+}
+
+// sourceCodeExtractor indexes common source file extensions as plain
+// text.
+type sourceCodeExtractor struct{}
+
+func (sourceCodeExtractor) Extensions() []string {
+	return []string{
+		".go", ".py", ".js", ".ts", ".java", ".c", ".h", ".cc", ".cpp",
+		".rs", ".rb", ".sh", ".swift", ".kt", ".m",
+	}
+}
+func (sourceCodeExtractor) MimeTypes() []string { return nil }
+func (sourceCodeExtractor) DocType() string     { return "code" }
+func (sourceCodeExtractor) Extract(
+	_ context.Context, r io.Reader, maxSize int64) (string, error) {
+	return readLimited(r, maxSize)
+}
@@ -0,0 +1,488 @@
+// Copyright 2019 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/keybase/client/go/kbfs/data"
+	"github.com/keybase/client/go/kbfs/kbfsmd"
+	"github.com/keybase/client/go/kbfs/libfs"
+	"github.com/keybase/client/go/kbfs/libkbfs"
+	"github.com/keybase/client/go/kbfs/tlf"
+	"github.com/pkg/errors"
+)
+
+const cursorFileName = "cursors.json"
+
+// IndexTLF registers handle to be indexed, in addition to whatever TLFs
+// NewIndexer already set up. If a cursor was persisted for this TLF from
+// a previous run and it's still current, indexing is skipped entirely;
+// otherwise the whole tree is walked and indexed from scratch via
+// Index. See syncTLF's doc comment for why that's a full re-walk and
+// not a replay of just what changed since the cursor.
+func (i *Indexer) IndexTLF(ctx context.Context, handle *libkbfs.TlfHandle) error {
+	tlfID := handle.TlfID()
+
+	i.mu.Lock()
+	_, already := i.tlfs[tlfID]
+	i.mu.Unlock()
+	if already {
+		return nil
+	}
+
+	cursors, err := i.loadCursors()
+	if err != nil {
+		return err
+	}
+	cursor, hasCursor := cursors[tlfID]
+
+	rootFS, err := libfs.NewFS(
+		ctx, i.config, handle, data.MasterBranch, "", "", 0)
+	if err != nil {
+		return err
+	}
+
+	latest, err := i.syncTLF(ctx, handle, rootFS, cursor, hasCursor)
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	i.tlfs[tlfID] = &tlfState{handle: handle, cursor: latest}
+	i.mu.Unlock()
+	return i.saveCursor(tlfID, latest)
+}
+
+// syncTLF brings the index for handle up to date and returns the
+// revision the index is now current as of.
+//
+// The cursor this compares against only gates a skip-if-unchanged
+// decision, not an incremental replay: KBFSOps().GetUpdateHistory reports
+// a TLF's update history for human-readable display (kbfsmd.Revision plus
+// a per-op summary of ref/unref block pointers, not relative paths), and
+// has no revision-range variant that would let us ask for "everything
+// since cursor" against a starting revision. So whenever the cursor is
+// missing or behind the TLF's current revision -- whether because
+// hasCursor is false (first run) or because writes landed while this
+// Indexer wasn't running -- catching up means a full re-walk via Index,
+// the same walk resyncTLF runs when handleNodeChange falls back to it for
+// a change notification it can't otherwise place. Once caught up, live writes
+// while Start is running are applied incrementally, since those deliver
+// an actual Node per change rather than just a revision number.
+func (i *Indexer) syncTLF(
+	ctx context.Context, handle *libkbfs.TlfHandle, rootFS *libfs.FS,
+	cursor kbfsmd.Revision, hasCursor bool) (kbfsmd.Revision, error) {
+	fb := data.FolderBranch{Tlf: handle.TlfID(), Branch: data.MasterBranch}
+	latest, err := i.latestRevision(ctx, fb)
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, err
+	}
+
+	if !hasCursor || cursor != latest {
+		if err := i.Index(ctx, handle, rootFS); err != nil {
+			return kbfsmd.RevisionUninitialized, err
+		}
+	}
+	return latest, nil
+}
+
+// resyncTLF re-walks the whole of handle's TLF, the same full walk
+// IndexTLF runs for a new or stale cursor. handleNodeChange falls back to
+// it when a change notification's Node isn't in nodePaths at all, since
+// without a cached path there's nothing to resolve the notification to
+// other than starting over.
+func (i *Indexer) resyncTLF(ctx context.Context, handle *libkbfs.TlfHandle) error {
+	rootFS, err := libfs.NewFS(
+		ctx, i.config, handle, data.MasterBranch, "", "", 0)
+	if err != nil {
+		return err
+	}
+	return i.Index(ctx, handle, rootFS)
+}
+
+// latestRevision returns the most recent revision recorded in fb's update
+// history, or kbfsmd.RevisionInitial if the TLF has no history yet.
+func (i *Indexer) latestRevision(
+	ctx context.Context, fb data.FolderBranch) (kbfsmd.Revision, error) {
+	history, err := i.config.KBFSOps().GetUpdateHistory(ctx, fb)
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, err
+	}
+	if len(history.Updates) == 0 {
+		return kbfsmd.RevisionInitial, nil
+	}
+	return history.Updates[len(history.Updates)-1].Revision, nil
+}
+
+// reindexRelPath re-indexes, or if it no longer exists removes from the
+// index, the entry at relPath (forward-slash separated, relative to
+// handle's TLF root), caching node's path for future incremental
+// updates. node is the already-resolved Node handleNodeChange was
+// notified about; reindexRelPath trusts it rather than re-deriving it
+// via resolveNode's root-to-leaf Lookup walk, since the caller already
+// paid for that resolution once. If the entry is a directory, its
+// immediate children are synced too -- including any that aren't yet in
+// nodePaths -- so that a change notification for a directory (which is
+// what fires when a file is newly created in it, since there's no Node
+// for a not-yet-existing file to notify about) is enough to pick up the
+// new entry, not just changes to ones doIndexDir already walked.
+func (i *Indexer) reindexRelPath(
+	ctx context.Context, handle *libkbfs.TlfHandle, node libkbfs.Node,
+	relPath string) error {
+	relPath = strings.Trim(relPath, "/")
+	dir, name := path.Split(relPath)
+	dir = strings.Trim(dir, "/")
+
+	parentFS, err := libfs.NewFS(
+		ctx, i.config, handle, data.MasterBranch, "", "", 0)
+	if err != nil {
+		return err
+	}
+	if dir != "" {
+		for _, component := range strings.Split(dir, "/") {
+			parentFS, err = parentFS.ChrootAsLibFS(component)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	fi, err := parentFS.Stat(name)
+	switch {
+	case os.IsNotExist(errors.Cause(err)):
+		return i.index.Delete(docID(handle, relPath))
+	case err != nil:
+		return err
+	}
+
+	id, f, err := i.indexEntry(ctx, handle, parentFS, dir, fi)
+	if err != nil {
+		return err
+	}
+	if err := i.index.Index(id, f); err != nil {
+		return err
+	}
+
+	i.cacheNodePath(node, relPath)
+
+	if !fi.IsDir() {
+		return nil
+	}
+	entryFS, err := parentFS.ChrootAsLibFS(name)
+	if err != nil {
+		return err
+	}
+	return i.syncDirChildren(ctx, handle, entryFS, node, relPath)
+}
+
+// syncDirChildren indexes and caches the path of every immediate child of
+// dirNode (found at relPath), without recursing further -- each
+// subdirectory is either already tracked from the initial walk or will be
+// synced the same way by its own change notification. This is the piece
+// that lets reindexRelPath pick up entries doIndexDir never saw, since a
+// newly created file's Node isn't cached anywhere until its directory is
+// synced at least once after the file appears.
+func (i *Indexer) syncDirChildren(
+	ctx context.Context, handle *libkbfs.TlfHandle, fs *libfs.FS,
+	dirNode libkbfs.Node, relPath string) error {
+	children, err := fs.ReadDir("")
+	if err != nil {
+		return err
+	}
+	for _, fi := range children {
+		name := fi.Name()
+		if shouldIgnoreEntry(name) {
+			continue
+		}
+		childRelPath := libfsJoinRelPath(relPath, name)
+
+		childNode, _, err := i.config.KBFSOps().Lookup(ctx, dirNode, name)
+		if err != nil {
+			return err
+		}
+		i.cacheNodePath(childNode, childRelPath)
+
+		id, f, err := i.indexEntry(ctx, handle, fs, relPath, fi)
+		if err != nil {
+			return err
+		}
+		if err := i.index.Index(id, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeObserver relays KBFS change notifications for a single TLF to
+// the Indexer that registered it.
+type changeObserver struct {
+	indexer *Indexer
+	tlfID   tlf.ID
+	handle  *libkbfs.TlfHandle
+}
+
+func (o *changeObserver) LocalChange(
+	ctx context.Context, node libkbfs.Node, write libkbfs.WriteRange) {
+	o.indexer.handleNodeChange(ctx, o.tlfID, o.handle, node)
+}
+
+func (o *changeObserver) BatchChanges(
+	ctx context.Context, changes []libkbfs.NodeChange,
+	affectedNodeIDs []libkbfs.NodeID) {
+	for _, change := range changes {
+		o.indexer.handleNodeChange(ctx, o.tlfID, o.handle, change.Node)
+	}
+}
+
+func (o *changeObserver) TlfHandleChange(
+	ctx context.Context, newHandle *libkbfs.TlfHandle) {
+	o.indexer.mu.Lock()
+	defer o.indexer.mu.Unlock()
+	if st, ok := o.indexer.tlfs[o.tlfID]; ok {
+		st.handle = newHandle
+	}
+	o.handle = newHandle
+}
+
+// handleNodeChange re-indexes the path backing node, or, if node isn't
+// one reindexRelPath or doIndexDir has ever cached a path for, falls back
+// to resyncTLF. That fallback is what makes a brand new file or directory
+// -- which has no Node in nodePaths until the first time its parent is
+// synced -- actually reachable: without a cached path there's nothing to
+// resolve the notification to, but the notification did happen, so
+// dropping it silently would mean the change never gets indexed until the
+// next process restart. beginResync/endResync collapse a burst of such
+// notifications (e.g. many files landing in one directory at once, each
+// with its own uncached Node) into a single re-walk instead of one per
+// notification.
+//
+// handleNodeChange does not touch the persisted cursor either way: that
+// would mean a GetUpdateHistory round trip on every single node change
+// just to learn the current revision, which is wasteful on a busy TLF.
+// Instead flushCursors snapshots the cursor once, when Stop is called; a
+// crash between node changes and the next Stop just means syncTLF falls
+// back to a full re-walk on the next IndexTLF, which is correct, only not
+// incremental for that one restart.
+func (i *Indexer) handleNodeChange(
+	ctx context.Context, tlfID tlf.ID, handle *libkbfs.TlfHandle,
+	node libkbfs.Node) {
+	log := i.config.MakeLogger("search")
+	relPath, ok := i.lookupNodePath(node)
+	if !ok {
+		if !i.beginResync(tlfID) {
+			log.CDebugf(ctx,
+				"no cached path for node %v in TLF %s, but a re-walk is "+
+					"already in progress; skipping", node.GetID(), tlfID)
+			return
+		}
+		defer i.endResync(tlfID)
+		log.CDebugf(ctx,
+			"no cached path for node %v in TLF %s; falling back to a full re-walk",
+			node.GetID(), tlfID)
+		if err := i.resyncTLF(ctx, handle); err != nil {
+			log.CWarningf(ctx,
+				"failed to re-walk TLF %s after uncached node change: %+v",
+				tlfID, err)
+		}
+		return
+	}
+	if err := i.reindexRelPath(ctx, handle, node, relPath); err != nil {
+		log.CWarningf(ctx, "failed to reindex %q in TLF %s: %+v",
+			relPath, tlfID, err)
+	}
+}
+
+// beginResync reports whether tlfID has no resyncTLF already in flight,
+// and if so marks one as started. endResync must be called to clear that
+// mark once it finishes.
+func (i *Indexer) beginResync(tlfID tlf.ID) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.resyncing == nil {
+		i.resyncing = map[tlf.ID]bool{}
+	}
+	if i.resyncing[tlfID] {
+		return false
+	}
+	i.resyncing[tlfID] = true
+	return true
+}
+
+func (i *Indexer) endResync(tlfID tlf.ID) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.resyncing, tlfID)
+}
+
+// Start subscribes to KBFS change notifications for every TLF registered
+// so far (via NewIndexer or IndexTLF) and applies them to the index in
+// the background until Stop is called.
+func (i *Indexer) Start(ctx context.Context) error {
+	i.mu.Lock()
+	if i.cancel != nil {
+		i.mu.Unlock()
+		return errors.New("indexer already started")
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	i.cancel = cancel
+	i.stopped = make(chan struct{})
+	states := make([]*tlfState, 0, len(i.tlfs))
+	tlfIDs := make([]tlf.ID, 0, len(i.tlfs))
+	for id, st := range i.tlfs {
+		states = append(states, st)
+		tlfIDs = append(tlfIDs, id)
+	}
+	i.mu.Unlock()
+
+	var registered []registeredObserver
+	for n, st := range states {
+		obs := &changeObserver{indexer: i, tlfID: tlfIDs[n], handle: st.handle}
+		fb := data.FolderBranch{Tlf: tlfIDs[n], Branch: data.MasterBranch}
+		if err := i.config.Notifier().RegisterForChanges(
+			[]data.FolderBranch{fb}, obs); err != nil {
+			for _, r := range registered {
+				_ = i.config.Notifier().UnregisterFromChanges(
+					[]data.FolderBranch{r.fb}, r.obs)
+			}
+			cancel()
+			return err
+		}
+		registered = append(registered, registeredObserver{fb: fb, obs: obs})
+	}
+
+	i.mu.Lock()
+	i.registered = registered
+	i.mu.Unlock()
+
+	go func() {
+		defer close(i.stopped)
+		<-watchCtx.Done()
+	}()
+	return nil
+}
+
+// Stop ends the background loop started by Start, unregisters its change
+// observers, flushes a current cursor for every tracked TLF, and waits
+// for the loop to exit. It is a no-op if Start was never called.
+func (i *Indexer) Stop() {
+	i.mu.Lock()
+	cancel := i.cancel
+	stopped := i.stopped
+	registered := i.registered
+	i.cancel = nil
+	i.registered = nil
+	i.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+
+	log := i.config.MakeLogger("search")
+	for _, r := range registered {
+		if err := i.config.Notifier().UnregisterFromChanges(
+			[]data.FolderBranch{r.fb}, r.obs); err != nil {
+			log.CWarningf(context.Background(),
+				"failed to unregister TLF %s: %+v", r.fb.Tlf, err)
+		}
+	}
+
+	cancel()
+	<-stopped
+	i.flushCursors(context.Background())
+}
+
+// flushCursors persists the current revision cursor for every tracked
+// TLF. It is the only place outside of IndexTLF that calls
+// GetUpdateHistory, so live node changes (handleNodeChange) stay cheap.
+func (i *Indexer) flushCursors(ctx context.Context) {
+	log := i.config.MakeLogger("search")
+	i.mu.Lock()
+	tlfIDs := make([]tlf.ID, 0, len(i.tlfs))
+	for id := range i.tlfs {
+		tlfIDs = append(tlfIDs, id)
+	}
+	i.mu.Unlock()
+
+	for _, tlfID := range tlfIDs {
+		fb := data.FolderBranch{Tlf: tlfID, Branch: data.MasterBranch}
+		latest, err := i.latestRevision(ctx, fb)
+		if err != nil {
+			log.CWarningf(ctx,
+				"failed to fetch latest revision for TLF %s: %+v", tlfID, err)
+			continue
+		}
+		i.mu.Lock()
+		if st, ok := i.tlfs[tlfID]; ok {
+			st.cursor = latest
+		}
+		i.mu.Unlock()
+		if err := i.saveCursor(tlfID, latest); err != nil {
+			log.CWarningf(ctx,
+				"failed to persist cursor for TLF %s: %+v", tlfID, err)
+		}
+	}
+}
+
+func (i *Indexer) loadCursors() (map[tlf.ID]kbfsmd.Revision, error) {
+	f, err := i.metaFS.OpenFile(cursorFileName, os.O_RDONLY, 0)
+	if os.IsNotExist(errors.Cause(err)) {
+		return map[tlf.ID]kbfsmd.Revision{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	raw, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var encoded map[string]kbfsmd.Revision
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &encoded); err != nil {
+			return nil, err
+		}
+	}
+
+	cursors := make(map[tlf.ID]kbfsmd.Revision, len(encoded))
+	for k, v := range encoded {
+		id, err := tlf.ParseID(k)
+		if err != nil {
+			return nil, err
+		}
+		cursors[id] = v
+	}
+	return cursors, nil
+}
+
+// saveCursor persists rev as the cursor for tlfID, alongside whatever
+// cursors are already known for other registered TLFs.
+func (i *Indexer) saveCursor(tlfID tlf.ID, rev kbfsmd.Revision) error {
+	i.mu.Lock()
+	encoded := make(map[string]kbfsmd.Revision, len(i.tlfs))
+	for id, st := range i.tlfs {
+		encoded[id.String()] = st.cursor
+	}
+	encoded[tlfID.String()] = rev
+	i.mu.Unlock()
+
+	raw, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	f, err := i.metaFS.OpenFile(
+		cursorFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(raw)
+	return err
+}
@@ -10,18 +10,108 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/blevesearch/bleve"
 	"github.com/keybase/client/go/kbfs/data"
+	"github.com/keybase/client/go/kbfs/kbfsmd"
 	"github.com/keybase/client/go/kbfs/libfs"
 	"github.com/keybase/client/go/kbfs/libkbfs"
 	"github.com/keybase/client/go/kbfs/tlf"
 	"github.com/pkg/errors"
 )
 
+// tlfState tracks an Indexer's bookkeeping for a single registered TLF.
+type tlfState struct {
+	handle *libkbfs.TlfHandle
+	cursor kbfsmd.Revision
+}
+
 type Indexer struct {
 	config libkbfs.Config
 	index  bleve.Index
+
+	// metaFS stores bookkeeping that isn't part of the Bleve index
+	// itself, such as per-TLF cursors.
+	metaFS *libfs.FS
+
+	mu   sync.Mutex
+	tlfs map[tlf.ID]*tlfState
+	// nodePaths caches the relative path each libkbfs.Node we've walked
+	// was found at, keyed by NodeID. KBFS change notifications hand us a
+	// Node with no path of its own, so this is how handleNodeChange knows
+	// what to re-index.
+	nodePaths  map[libkbfs.NodeID]string
+	cancel     context.CancelFunc
+	stopped    chan struct{}
+	registered []registeredObserver
+	// resyncing tracks, per TLF, whether a resyncTLF triggered by
+	// handleNodeChange's cache-miss fallback is already in flight, so a
+	// burst of notifications for uncached nodes (e.g. many files created
+	// at once) collapses into one re-walk instead of one per
+	// notification.
+	resyncing map[tlf.ID]bool
+
+	// keysMu guards keys, the (TLF, salt) -> derived index key cache used
+	// by indexKeyFor, so that opening the many segment files a Bleve
+	// index is made of doesn't each pay for deriveIndexKey's MDOps/
+	// KeyManager round trip.
+	keysMu sync.Mutex
+	keys   map[tlfSaltKey]indexKeyCacheEntry
+}
+
+// registeredObserver records a changeObserver registration made by Start,
+// so Stop can unregister the exact same (FolderBranch, Observer) pair.
+type registeredObserver struct {
+	fb  data.FolderBranch
+	obs libkbfs.Observer
+}
+
+// cacheNodePath remembers that node was found at relPath, for later
+// lookup by handleNodeChange.
+func (i *Indexer) cacheNodePath(node libkbfs.Node, relPath string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.nodePaths == nil {
+		i.nodePaths = map[libkbfs.NodeID]string{}
+	}
+	i.nodePaths[node.GetID()] = relPath
+}
+
+func (i *Indexer) lookupNodePath(node libkbfs.Node) (relPath string, ok bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	relPath, ok = i.nodePaths[node.GetID()]
+	return relPath, ok
+}
+
+// resolveNode walks from handle's TLF root down to relPath (forward-slash
+// separated, relative to the root), caching the path of every Node it
+// passes through along the way -- including the root and relPath itself
+// -- and returns the Node found at relPath.
+func (i *Indexer) resolveNode(
+	ctx context.Context, handle *libkbfs.TlfHandle, relPath string) (
+	libkbfs.Node, error) {
+	node, _, err := i.config.KBFSOps().GetOrCreateRootNode(
+		ctx, handle, data.MasterBranch)
+	if err != nil {
+		return nil, err
+	}
+	i.cacheNodePath(node, "")
+
+	built := ""
+	for _, component := range strings.Split(relPath, "/") {
+		if component == "" {
+			continue
+		}
+		node, _, err = i.config.KBFSOps().Lookup(ctx, node, component)
+		if err != nil {
+			return nil, err
+		}
+		built = libfsJoinRelPath(built, component)
+		i.cacheNodePath(node, built)
+	}
+	return node, nil
 }
 
 func indexPath(root string) string {
@@ -64,22 +154,50 @@ func NewIndexer(ctx context.Context, config libkbfs.Config) (*Indexer, error) {
 		return nil, err
 	}
 
+	tlfID := privateHandle.TlfID()
+	idx := &Indexer{
+		config: config,
+		metaFS: fs,
+		tlfs:   map[tlf.ID]*tlfState{},
+	}
+
 	var index bleve.Index
 	bleveConfig := map[string]interface{}{
-		"openFile": func(p string, f int, m os.FileMode) (io.ReadWriteCloser, error) { return fs.OpenFile(p, f, m) },
-		"mkdir":    fs.MkdirAll,
+		// openFile's hook outlives NewIndexer's call -- Scorch reopens
+		// segment files for as long as the index is open -- so it must
+		// not pin ctx, which is typically request-scoped and may be
+		// cancelled once NewIndexer returns. idx.indexKeyFor also caches
+		// the derived key per (TLF, salt), so only the first open of a
+		// given salt actually needs a live context to do an MDOps/
+		// KeyManager round trip at all.
+		"openFile": func(p string, f int, m os.FileMode) (io.ReadWriteCloser, error) {
+			raw, err := fs.OpenFile(p, f, m)
+			if err != nil {
+				return nil, err
+			}
+			ra, ok := raw.(randomAccessFile)
+			if !ok {
+				return nil, errors.Errorf(
+					"kbfs_index file %q does not support random-access I/O", p)
+			}
+			return newEncryptedFile(context.Background(), idx, tlfID, ra)
+		},
+		"mkdir": fs.MkdirAll,
 	}
 	p := "kbindex"
 	_, err = fs.Stat(p)
 	switch {
 	case os.IsNotExist(errors.Cause(err)):
-		mapping := bleve.NewIndexMapping()
+		im := newIndexMapping()
 		index, err = bleve.NewUsing(
-			p, mapping, "scorch", "kbindex", bleveConfig)
+			p, im, "scorch", "kbindex", bleveConfig)
 		if err != nil {
 			return nil, err
 		}
 	case err == nil:
+		if err := migrateIndexDir(ctx, idx, tlfID, fs); err != nil {
+			return nil, err
+		}
 		index, err = bleve.OpenUsing(p, bleveConfig)
 		if err != nil {
 			return nil, err
@@ -87,15 +205,20 @@ func NewIndexer(ctx context.Context, config libkbfs.Config) (*Indexer, error) {
 	default:
 		return nil, err
 	}
+	idx.index = index
 
-	return &Indexer{
-		index: index,
-	}, nil
+	if err := idx.IndexTLF(ctx, privateHandle); err != nil {
+		return nil, err
+	}
+	return idx, nil
 }
 
 type file struct {
 	Name          string
 	TokenizedName string
+	Content       string
+	DocType       string
+	Path          string
 }
 
 var filesToIgnore = map[string]bool{
@@ -104,7 +227,74 @@ var filesToIgnore = map[string]bool{
 	".DS_Store":  true,
 }
 
-func (i *Indexer) doIndexDir(fs *libfs.FS) error {
+// shouldIgnoreEntry reports whether name is filesystem bookkeeping that
+// doIndexDir and syncDirChildren both skip rather than indexing.
+func shouldIgnoreEntry(name string) bool {
+	return filesToIgnore[name] || strings.HasPrefix(name, "._")
+}
+
+// extractContent opens name under fs and runs it through extractor,
+// capping how much is read at maxIndexableFileSize.
+func (i *Indexer) extractContent(
+	ctx context.Context, fs *libfs.FS, name string, extractor ContentExtractor) (
+	string, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return extractor.Extract(ctx, f, maxIndexableFileSize)
+}
+
+// indexEntry builds the Bleve document and id for a single entry of fs,
+// whose directory is at relPath under handle's TLF root (so the entry
+// itself is at relPath/fi.Name()), extracting its content if a
+// ContentExtractor is registered for it. It does not recurse into
+// directories; callers that need to walk a tree use doIndexDir instead.
+func (i *Indexer) indexEntry(
+	ctx context.Context, handle *libkbfs.TlfHandle, fs *libfs.FS,
+	relPath string, fi os.FileInfo) (id string, f file, err error) {
+	name := fi.Name()
+	tokenized := strings.ReplaceAll(name, "_", " ")
+	tokenized = strings.ReplaceAll(tokenized, "-", " ")
+	tokenized = strings.ReplaceAll(tokenized, ".", " ")
+	entryPath := libfsJoinRelPath(relPath, name)
+	f = file{
+		Name:          name,
+		TokenizedName: tokenized,
+		Path:          canonicalKBFSPath(handle, entryPath),
+	}
+
+	if !fi.IsDir() && fi.Size() <= maxIndexableFileSize {
+		if extractor := extractorFor(name); extractor != nil {
+			content, err := i.extractContent(ctx, fs, name, extractor)
+			if err == nil {
+				f.Content = content
+				f.DocType = extractor.DocType()
+			}
+			// A file that can't be read or parsed for content is still
+			// indexed by name below.
+		}
+	}
+
+	return docID(handle, entryPath), f, nil
+}
+
+func libfsJoinRelPath(relPath, name string) string {
+	if relPath == "" {
+		return name
+	}
+	return relPath + "/" + name
+}
+
+// doIndexDir walks fs, indexing every entry under it. dirNode is the
+// libkbfs.Node for fs's own directory (relPath); as doIndexDir descends,
+// it looks up each child's Node via KBFSOps().Lookup and caches its path,
+// so that a later KBFS change notification for that Node can be resolved
+// back to a relative path by handleNodeChange.
+func (i *Indexer) doIndexDir(
+	ctx context.Context, handle *libkbfs.TlfHandle, fs *libfs.FS,
+	dirNode libkbfs.Node, relPath string) error {
 	children, err := fs.ReadDir("")
 	if err != nil {
 		return err
@@ -112,29 +302,31 @@ func (i *Indexer) doIndexDir(fs *libfs.FS) error {
 
 	for _, fi := range children {
 		name := fi.Name()
-		if filesToIgnore[name] || strings.HasPrefix(name, "._") {
+		if shouldIgnoreEntry(name) {
 			continue
 		}
+		childRelPath := libfsJoinRelPath(relPath, name)
 
-		tokenized := strings.ReplaceAll(name, "_", " ")
-		tokenized = strings.ReplaceAll(tokenized, "-", " ")
-		tokenized = strings.ReplaceAll(tokenized, ".", " ")
-		f := file{
-			Name:          name,
-			TokenizedName: tokenized,
+		childNode, _, err := i.config.KBFSOps().Lookup(ctx, dirNode, name)
+		if err != nil {
+			return err
 		}
-		id := fs.Join(fs.Root(), name)
-		err := i.index.Index(id, f)
+		i.cacheNodePath(childNode, childRelPath)
+
+		id, f, err := i.indexEntry(ctx, handle, fs, relPath, fi)
 		if err != nil {
 			return err
 		}
+		if err := i.index.Index(id, f); err != nil {
+			return err
+		}
 
 		if fi.IsDir() {
 			childFS, err := fs.ChrootAsLibFS(name)
 			if err != nil {
 				return err
 			}
-			err = i.doIndexDir(childFS)
+			err = i.doIndexDir(ctx, handle, childFS, childNode, childRelPath)
 			if err != nil {
 				return err
 			}
@@ -143,20 +335,16 @@ func (i *Indexer) doIndexDir(fs *libfs.FS) error {
 	return nil
 }
 
-func (i *Indexer) Index(fs *libfs.FS) error {
-	return i.doIndexDir(fs)
-}
-
-func (i *Indexer) Search(queryString string) (paths []string, err error) {
-	query := bleve.NewQueryStringQuery(queryString)
-	request := bleve.NewSearchRequest(query)
-	result, err := i.index.Search(request)
+// Index walks fs, indexing every entry under it as belonging to handle's
+// TLF.
+func (i *Indexer) Index(
+	ctx context.Context, handle *libkbfs.TlfHandle, fs *libfs.FS) error {
+	rootNode, _, err := i.config.KBFSOps().GetOrCreateRootNode(
+		ctx, handle, data.MasterBranch)
 	if err != nil {
-		return nil, err
-	}
-
-	for _, hit := range result.Hits {
-		paths = append(paths, hit.ID)
+		return err
 	}
-	return paths, nil
+	i.cacheNodePath(rootNode, "")
+	return i.doIndexDir(ctx, handle, fs, rootNode, "")
 }
+
@@ -0,0 +1,74 @@
+// Copyright 2019 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+)
+
+// maxIndexableFileSize bounds how much of a single file's content is read
+// and fed to Bleve. Files larger than this are still indexed by name, just
+// not by content.
+const maxIndexableFileSize = 20 * 1024 * 1024 // 20 MiB
+
+// Bleve field names for the file struct, shared with query construction
+// and result parsing in search.go.
+const (
+	fieldName          = "Name"
+	fieldTokenizedName = "TokenizedName"
+	fieldContent       = "Content"
+	// fieldPath holds the human-readable canonical KBFS path. It is
+	// stored for display and exact-path lookups, but kept out of the
+	// default (_all) query and left unanalyzed, since it's noise for
+	// free-text search, not a thing to search for by term.
+	fieldPath = "Path"
+)
+
+// docTypes are the Bleve document mapping names used for the DocType field
+// of the file struct, one per DocType() of the extractors this package
+// registers itself. Files with no recognized content extractor, or whose
+// extractor reports any other DocType, fall back to the default mapping.
+var docTypes = []string{"text", "markdown", "code"}
+
+// newIndexMapping builds the Bleve index mapping used by NewIndexer. Every
+// file gets a Name and TokenizedName field; files with extracted content
+// additionally get a Content field analyzed under the mapping selected by
+// their DocType, so that extractors for different kinds of content (plain
+// text today, others as they're registered) can eventually choose
+// different analyzers without affecting the rest of the index.
+func newIndexMapping() *mapping.IndexMapping {
+	im := bleve.NewIndexMapping()
+	im.TypeField = "DocType"
+	im.DefaultMapping = newFileDocMapping()
+	for _, docType := range docTypes {
+		im.AddDocumentMapping(docType, newFileDocMapping())
+	}
+	return im
+}
+
+func newFileDocMapping() *mapping.DocumentMapping {
+	doc := bleve.NewDocumentMapping()
+
+	name := bleve.NewTextFieldMapping()
+	name.Analyzer = "standard"
+	doc.AddFieldMappingsAt(fieldName, name)
+
+	tokenizedName := bleve.NewTextFieldMapping()
+	tokenizedName.Analyzer = "standard"
+	doc.AddFieldMappingsAt(fieldTokenizedName, tokenizedName)
+
+	content := bleve.NewTextFieldMapping()
+	content.Analyzer = "standard"
+	doc.AddFieldMappingsAt(fieldContent, content)
+
+	pathField := bleve.NewTextFieldMapping()
+	pathField.Analyzer = keyword.Name
+	pathField.IncludeInAll = false
+	doc.AddFieldMappingsAt(fieldPath, pathField)
+
+	return doc
+}
@@ -0,0 +1,248 @@
+// Copyright 2019 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/highlight/highlighter/ansi"
+	"github.com/blevesearch/bleve/search/highlight/highlighter/html"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// SearchField names a field of the index that Search can be restricted
+// to.
+type SearchField string
+
+const (
+	// SearchFieldName matches against a file's name.
+	SearchFieldName SearchField = "name"
+	// SearchFieldContent matches against a file's extracted content.
+	SearchFieldContent SearchField = "content"
+)
+
+// HighlightStyle selects the markup Search uses for FieldMatch.Fragments.
+type HighlightStyle string
+
+const (
+	// HighlightStyleNone disables highlighting.
+	HighlightStyleNone HighlightStyle = ""
+	// HighlightStyleHTML wraps matched terms in <mark> tags.
+	HighlightStyleHTML HighlightStyle = html.Name
+	// HighlightStyleANSI wraps matched terms in ANSI escape codes, for a
+	// terminal UI.
+	HighlightStyleANSI HighlightStyle = ansi.Name
+)
+
+// SearchOptions controls how Indexer.Search runs a query.
+type SearchOptions struct {
+	// Fields restricts which indexed fields are queried. A nil or empty
+	// slice searches both name and content.
+	Fields []SearchField
+	// Highlight selects the fragment markup for FieldMatch.Fragments. The
+	// zero value, HighlightStyleNone, skips highlighting.
+	Highlight HighlightStyle
+}
+
+func (o SearchOptions) queryFields() []string {
+	var fields []string
+	for _, f := range o.Fields {
+		switch f {
+		case SearchFieldName:
+			fields = append(fields, fieldName, fieldTokenizedName)
+		case SearchFieldContent:
+			fields = append(fields, fieldContent)
+		}
+	}
+	return fields
+}
+
+func (o SearchOptions) buildQuery(queryString string) query.Query {
+	fields := o.queryFields()
+	if len(fields) == 0 {
+		return bleve.NewQueryStringQuery(queryString)
+	}
+	disjunction := bleve.NewDisjunctionQuery()
+	for _, field := range fields {
+		fieldQuery := bleve.NewMatchQuery(queryString)
+		fieldQuery.SetField(field)
+		disjunction.AddQuery(fieldQuery)
+	}
+	return disjunction
+}
+
+// MatchLevel summarizes how thoroughly a Match satisfied the query.
+type MatchLevel int
+
+const (
+	// MatchLevelNone means none of the query terms were found; Bleve
+	// shouldn't return these, but the zero value is defined for
+	// completeness.
+	MatchLevelNone MatchLevel = iota
+	// MatchLevelPartial means some, but not all, query terms were found.
+	MatchLevelPartial
+	// MatchLevelFull means every query term was found somewhere in the
+	// document.
+	MatchLevelFull
+)
+
+func (l MatchLevel) String() string {
+	switch l {
+	case MatchLevelFull:
+		return "full"
+	case MatchLevelPartial:
+		return "partial"
+	default:
+		return "none"
+	}
+}
+
+// FieldMatch describes how a query matched a single field of a document.
+type FieldMatch struct {
+	// Value is the field's full, stored value.
+	Value string
+	// Fragments are highlighted excerpts around each match. Populated
+	// only when SearchOptions.Highlight is not HighlightStyleNone.
+	Fragments []string
+	// Terms are the distinct query terms matched in this field.
+	Terms []string
+}
+
+// Match is one hit from Indexer.Search.
+type Match struct {
+	// ID is the hit's opaque Bleve document id. Pass it to ResolveHit to
+	// walk back to the libkbfs.Node it came from.
+	ID string
+	// Path is the human-readable canonical KBFS path of the hit, e.g.
+	// "/keybase/private/alice,bob/notes/todo.md".
+	Path          string
+	Score         float64
+	MatchLevel    MatchLevel
+	MatchedFields map[string]FieldMatch
+}
+
+func fieldDisplayName(field string) string {
+	if field == fieldContent {
+		return string(SearchFieldContent)
+	}
+	return string(SearchFieldName)
+}
+
+// queryTermSet analyzes queryString the same way indexed content is
+// analyzed, so the resulting terms are comparable to the ones
+// hitToMatch reads back out of hit.Locations. A naive whitespace split
+// compares raw query text (which may include field prefixes like
+// "name:", operators like "+"/"-", or differently-cased/stemmed words)
+// against analyzed terms, so it practically never reports a full match.
+func (i *Indexer) queryTermSet(queryString string) map[string]bool {
+	terms := map[string]bool{}
+	analyzer := i.index.Mapping().AnalyzerNamed("standard")
+	if analyzer == nil {
+		// Should always be registered by newIndexMapping; fall back to a
+		// naive split rather than reporting no terms at all.
+		for _, term := range strings.Fields(strings.ToLower(queryString)) {
+			terms[term] = true
+		}
+		return terms
+	}
+	for _, token := range analyzer.Analyze([]byte(queryString)) {
+		terms[string(token.Term)] = true
+	}
+	return terms
+}
+
+func hitToMatch(hit *search.DocumentMatch, queryTerms map[string]bool) Match {
+	matchedFields := map[string]FieldMatch{}
+	matchedTerms := map[string]bool{}
+
+	for _, field := range []string{fieldName, fieldTokenizedName, fieldContent} {
+		value, ok := hit.Fields[field]
+		if !ok {
+			continue
+		}
+		str, _ := value.(string)
+
+		display := fieldDisplayName(field)
+		fm := matchedFields[display]
+		if fm.Value == "" {
+			fm.Value = str
+		}
+		fm.Fragments = append(fm.Fragments, hit.Fragments[field]...)
+		for term := range hit.Locations[field] {
+			matchedTerms[term] = true
+			seen := false
+			for _, t := range fm.Terms {
+				if t == term {
+					seen = true
+					break
+				}
+			}
+			if !seen {
+				fm.Terms = append(fm.Terms, term)
+			}
+		}
+		matchedFields[display] = fm
+	}
+
+	level := MatchLevelNone
+	switch {
+	case len(queryTerms) > 0 && len(matchedTerms) >= len(queryTerms):
+		level = MatchLevelFull
+	case len(matchedTerms) > 0:
+		level = MatchLevelPartial
+	}
+
+	path, _ := hit.Fields[fieldPath].(string)
+	return Match{
+		ID:            hit.ID,
+		Path:          path,
+		Score:         hit.Score,
+		MatchLevel:    level,
+		MatchedFields: matchedFields,
+	}
+}
+
+// Search runs queryString against the index according to opts, returning
+// one Match per hit with its score, match level, and (if requested)
+// highlighted fragments.
+func (i *Indexer) Search(queryString string, opts SearchOptions) (
+	matches []Match, err error) {
+	request := bleve.NewSearchRequest(opts.buildQuery(queryString))
+	request.Fields = []string{fieldName, fieldTokenizedName, fieldContent, fieldPath}
+	// hitToMatch reads matched terms from hit.Locations, which Bleve only
+	// fills in when locations (or highlighting) are requested.
+	request.IncludeLocations = true
+	if opts.Highlight != HighlightStyleNone {
+		request.Highlight = bleve.NewHighlightWithStyle(string(opts.Highlight))
+		request.Highlight.Fields = []string{fieldName, fieldTokenizedName, fieldContent}
+	}
+
+	result, err := i.index.Search(request)
+	if err != nil {
+		return nil, err
+	}
+
+	queryTerms := i.queryTermSet(queryString)
+	for _, hit := range result.Hits {
+		matches = append(matches, hitToMatch(hit, queryTerms))
+	}
+	return matches, nil
+}
+
+// SearchPaths runs queryString the same way Search does, but returns just
+// the matched paths, for callers that don't need scores or highlights.
+func (i *Indexer) SearchPaths(queryString string, opts SearchOptions) (
+	paths []string, err error) {
+	matches, err := i.Search(queryString, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		paths = append(paths, m.Path)
+	}
+	return paths, nil
+}
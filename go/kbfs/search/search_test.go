@@ -0,0 +1,58 @@
+// Copyright 2019 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package search
+
+import (
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIndexer(t *testing.T) *Indexer {
+	index, err := bleve.NewMemOnly(newIndexMapping())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = index.Close() })
+	return &Indexer{index: index}
+}
+
+func TestQueryTermSetUsesStandardAnalyzer(t *testing.T) {
+	idx := newTestIndexer(t)
+	terms := idx.queryTermSet("The Quick-Brown fox")
+	require.True(t, terms["the"])
+	require.True(t, terms["quick"])
+	require.True(t, terms["brown"])
+	require.True(t, terms["fox"])
+}
+
+func TestSearchMatchLevelFullWhenAllTermsMatch(t *testing.T) {
+	idx := newTestIndexer(t)
+	require.NoError(t, idx.index.Index("doc1", file{
+		Name: "todo.md", Content: "buy milk and eggs", Path: "/keybase/private/alice/todo.md",
+	}))
+
+	matches, err := idx.Search("milk eggs", SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	require.Equal(t, MatchLevelFull, matches[0].MatchLevel)
+}
+
+func TestSearchMatchLevelPartialWhenSomeTermsMatch(t *testing.T) {
+	idx := newTestIndexer(t)
+	require.NoError(t, idx.index.Index("doc1", file{
+		Name: "todo.md", Content: "buy milk", Path: "/keybase/private/alice/todo.md",
+	}))
+
+	matches, err := idx.Search("milk eggs", SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	require.Equal(t, MatchLevelPartial, matches[0].MatchLevel)
+}
+
+func TestMatchLevelString(t *testing.T) {
+	require.Equal(t, "none", MatchLevelNone.String())
+	require.Equal(t, "partial", MatchLevelPartial.String())
+	require.Equal(t, "full", MatchLevelFull.String())
+}